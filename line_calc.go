@@ -10,6 +10,8 @@ import (
 	"math"
 	"math/big"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/chzyer/readline"
@@ -24,7 +26,195 @@ const (
 
 var width int
 
-var tblIdent = map[string]*big.Float{}
+// identVal is a variable's stored value. rat is its exact rational
+// representation, or nil if val came from an inexact (transcendental)
+// computation — every finite big.Float has *some* binary-fraction
+// rational, so that exactness can't be recovered from val alone on read.
+type identVal struct {
+	val *big.Float
+	rat *big.Rat
+}
+
+var tblIdent = map[string]*identVal{}
+
+// funcDef is a user-defined function registered via "f(x,y) = expr".
+// src keeps the right-hand side as typed (before preconv) for the :funcs
+// listing; body is what actually gets evaluated.
+type funcDef struct {
+	params []string
+	body   ast.Expr
+	src    string
+}
+
+var tblFunc = map[string]*funcDef{}
+
+var (
+	reFuncDef = regexp.MustCompile(`^\s*([A-Za-z_]\w*)\s*\(\s*([A-Za-z_]\w*(?:\s*,\s*[A-Za-z_]\w*)*)?\s*\)\s*=\s*(.+?)\s*$`)
+	reAssign  = regexp.MustCompile(`^\s*([A-Za-z_]\w*)\s*=\s*(.+?)\s*$`)
+)
+
+// parseFuncDef recognizes "name(p1, p2, ...) = expr" at the REPL.
+func parseFuncDef(line string) (name string, params []string, rhs string, ok bool) {
+	m := reFuncDef.FindStringSubmatch(line)
+	if m == nil {
+		return "", nil, "", false
+	}
+
+	if m[2] != "" {
+		for _, p := range strings.Split(m[2], ",") {
+			params = append(params, strings.TrimSpace(p))
+		}
+	}
+
+	return m[1], params, m[3], true
+}
+
+// parseAssign recognizes "name = expr" at the REPL.
+func parseAssign(line string) (name, rhs string, ok bool) {
+	m := reAssign.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// outputMode forces answer's display between the exact rational form and
+// the big.Float approximation; "auto" shows the rational form whenever one
+// is available. Set via the :rat / :float REPL directives in main.
+var outputMode = "auto"
+
+// outFormat holds the display configuration set by the :fmt REPL
+// directive, consulted by formatAnswer in place of the historic
+// hard-coded decimal/hex/binary branches.
+//
+//	:fmt auto        - decimal (+ hex/binary for integers); the default
+//	:fmt sci N       - scientific notation, N digits after the decimal point
+//	:fmt fix N       - fixed-point notation, N fractional digits
+//	:fmt base N      - integer display in base N (2, 8, 16 or 36)
+//	:fmt eng         - engineering notation with an SI suffix
+type outFormat struct {
+	mode   string
+	digits int
+	base   int
+}
+
+var fmtState = outFormat{mode: "auto"}
+
+var engSuffixes = map[int]string{
+	-12: "p",
+	-9:  "n",
+	-6:  "µ",
+	-3:  "m",
+	0:   "",
+	3:   "k",
+	6:   "M",
+	9:   "G",
+	12:  "T",
+}
+
+var baseGroup = map[int]int{2: 8, 8: 3, 16: 4, 36: 4}
+
+// parseFmtDirective handles ":fmt ..." lines from the REPL, updating
+// fmtState in place.
+func parseFmtDirective(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return errors.New("usage: :fmt auto|sci N|fix N|base N|eng")
+	}
+
+	switch fields[1] {
+	case "auto", "eng":
+		fmtState = outFormat{mode: fields[1]}
+	case "sci", "fix":
+		if len(fields) < 3 {
+			return fmt.Errorf(":fmt %s needs a digit count", fields[1])
+		}
+		n, err := strconv.Atoi(fields[2])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid digit count %q", fields[2])
+		}
+		fmtState = outFormat{mode: fields[1], digits: n}
+	case "base":
+		if len(fields) < 3 {
+			return errors.New(":fmt base needs a radix")
+		}
+		n, err := strconv.Atoi(fields[2])
+		if err != nil || baseGroup[n] == 0 {
+			return fmt.Errorf("unsupported base %q (use 2, 8, 16 or 36)", fields[2])
+		}
+		fmtState = outFormat{mode: "base", base: n}
+	default:
+		return fmt.Errorf("unknown :fmt mode %q", fields[1])
+	}
+
+	return nil
+}
+
+// formatEng renders ans in engineering notation: the exponent is forced
+// to a multiple of three and shown as an SI suffix from engSuffixes,
+// falling back to plain "eNN" outside that table's range.
+func formatEng(ans *big.Float) string {
+	if ans.Sign() == 0 {
+		return "0"
+	}
+
+	neg := ans.Sign() < 0
+	abs := new(big.Float).SetPrec(precision).Abs(ans)
+
+	text := abs.Text('e', 10)
+	parts := strings.SplitN(text, "e", 2)
+	exp, _ := strconv.Atoi(parts[1])
+
+	shift := ((exp % 3) + 3) % 3
+	mant := shiftDecimalPoint(parts[0], shift)
+	exp3 := exp - shift
+
+	sign := ""
+	if neg {
+		sign = "-"
+	}
+
+	if suffix, ok := engSuffixes[exp3]; ok {
+		return sign + mant + suffix
+	}
+	return sign + mant + fmt.Sprintf("e%+d", exp3)
+}
+
+// shiftDecimalPoint moves the decimal point in a "d.ddd" mantissa string
+// right by shift places, padding with zeros if necessary.
+func shiftDecimalPoint(s string, shift int) string {
+	if shift == 0 {
+		return s
+	}
+
+	dot := strings.IndexByte(s, '.')
+	digits := strings.Replace(s, ".", "", 1)
+	newDot := dot + shift
+	for len(digits) < newDot+1 {
+		digits += "0"
+	}
+
+	return digits[:newDot] + "." + digits[newDot:]
+}
+
+// formatBase renders v in the given radix, grouped for readability.
+func formatBase(v *big.Int, base int) string {
+	prefix := map[int]string{2: "0b", 8: "0o", 16: "0x", 36: ""}[base]
+
+	minus := ""
+	text := v.Text(base)
+	if strings.HasPrefix(text, "-") {
+		minus = "-"
+		text = text[1:]
+	}
+
+	return minus + prefix + separater(text, "_", baseGroup[base])
+}
+
+// piDecimal is the literal preconv substitutes for the bare word "pi"; it
+// is flagged as irrational so the rational evaluator doesn't treat a
+// truncated decimal expansion of pi as an exact value.
+const piDecimal = "3.14159265358979323846264338327950"
 
 var units = map[string]int64{
 	"K": 1024,
@@ -39,13 +229,18 @@ var units = map[string]int64{
 	"n": -1000 * 1000 * 1000,
 }
 
+// rePiWord matches the "pi" constant as a whole identifier only, so it
+// doesn't fire inside user identifiers that merely contain "pi" (e.g.
+// "pivot").
+var rePiWord = regexp.MustCompile(`\bpi\b`)
+
 func preconv(line string) string {
 	replacer := strings.NewReplacer(
 		"~", "!",
 		"**", "^",
-		"pi", "3.14159265358979323846264338327950",
 	)
 	s := replacer.Replace(line)
+	s = rePiWord.ReplaceAllString(s, piDecimal)
 
 	// "1K" => "1.(K)"
 	rs := `([)0-9a-fA-F ])(`
@@ -111,7 +306,70 @@ func operation2(op string, x, y *big.Float) (z *big.Float, err error) {
 	return z, err
 }
 
-func evalExpr(expr ast.Expr) (*big.Float, error) {
+// operation1Rat mirrors operation1 for the exact-rational evaluation path.
+// Only the sign operators are meaningful on a fraction; "!" is bitwise and
+// has no rational form.
+func operation1Rat(op string, x *big.Rat) (z *big.Rat, err error) {
+	switch op {
+	case "+":
+		z = x
+	case "-":
+		z = new(big.Rat).Neg(x)
+	default:
+		err = errors.New("not rational")
+	}
+	return z, err
+}
+
+// operation2Rat mirrors operation2 for the exact-rational evaluation path.
+// Only + - * / preserve exactness; the integer-only operators (%, ^, shifts,
+// bitwise) have no rational form and are left to the *big.Float path.
+func operation2Rat(op string, x, y *big.Rat) (z *big.Rat, err error) {
+	z = new(big.Rat)
+
+	switch op {
+	case "+":
+		z.Add(x, y)
+	case "-":
+		z.Sub(x, y)
+	case "*":
+		z.Mul(x, y)
+	case "/":
+		if y.Sign() == 0 {
+			return nil, errors.New("division by zero")
+		}
+		z.Quo(x, y)
+	default:
+		return nil, errors.New("not rational")
+	}
+
+	return z, nil
+}
+
+// traceMap, when non-nil, collects the evaluated value of every
+// sub-expression evalExpr visits, keyed by its ast.Node. It is populated
+// by traceLine for the Ctrl-T trace pane and left nil otherwise, so
+// ordinary evaluation pays no bookkeeping cost.
+var traceMap map[ast.Node]*big.Float
+
+// evalExpr evaluates expr both as a *big.Float (always) and, where the
+// expression is built entirely out of exact operations on exact operands,
+// as a *big.Rat. The rational result is nil wherever the expression passes
+// through a transcendental call, a non-rational literal, or an
+// integer-only operator; callers that don't care about exactness can
+// ignore the second return value.
+func evalExpr(expr ast.Expr) (*big.Float, *big.Rat, error) {
+	v, r, err := evalExprValue(expr)
+	if err == nil && traceMap != nil && v != nil {
+		// operation1/operation2 mutate their *big.Float operands in place,
+		// so later nodes can reuse this node's storage; snapshot a copy or
+		// the trace pane would show post-mutation values for earlier nodes.
+		traceMap[expr] = new(big.Float).Set(v)
+	}
+	return v, r, err
+}
+
+func evalExprValue(expr ast.Expr) (*big.Float, *big.Rat, error) {
 	switch e := expr.(type) {
 	case *ast.ParenExpr:
 		return evalExpr(e.X)
@@ -122,7 +380,18 @@ func evalExpr(expr ast.Expr) (*big.Float, error) {
 	case *ast.BasicLit:
 		x := new(big.Float).SetPrec(precision).SetMode(big.ToNearestEven)
 		_, err := fmt.Sscan(e.Value, x)
-		return x, err
+		if err != nil {
+			return x, nil, err
+		}
+
+		var r *big.Rat
+		if e.Value != piDecimal {
+			if rr, ok := new(big.Rat).SetString(e.Value); ok {
+				r = rr
+			}
+		}
+
+		return x, r, nil
 	case *ast.Ident:
 		return evalIdent(e)
 	case *ast.CallExpr:
@@ -131,111 +400,450 @@ func evalExpr(expr ast.Expr) (*big.Float, error) {
 		return evalUnit(e.X, e.Type)
 	}
 
-	return nil, errors.New("invalid expr")
+	return nil, nil, errors.New("invalid expr")
 }
 
-func evalBinaryExpr(expr *ast.BinaryExpr) (*big.Float, error) {
-	x, err := evalExpr(expr.X)
+func evalBinaryExpr(expr *ast.BinaryExpr) (*big.Float, *big.Rat, error) {
+	x, xr, err := evalExpr(expr.X)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	y, err := evalExpr(expr.Y)
+	y, yr, err := evalExpr(expr.Y)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return operation2(expr.Op.String(), x, y)
+	z, err := operation2(expr.Op.String(), x, y)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var zr *big.Rat
+	if xr != nil && yr != nil {
+		zr, _ = operation2Rat(expr.Op.String(), xr, yr)
+	}
+
+	return z, zr, nil
 }
 
-func evalUnaryExpr(expr *ast.UnaryExpr) (*big.Float, error) {
-	x, err := evalExpr(expr.X)
+func evalUnaryExpr(expr *ast.UnaryExpr) (*big.Float, *big.Rat, error) {
+	x, xr, err := evalExpr(expr.X)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	z, err := operation1(expr.Op.String(), x)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return operation1(expr.Op.String(), x)
+	var zr *big.Rat
+	if xr != nil {
+		zr, _ = operation1Rat(expr.Op.String(), xr)
+	}
+
+	return z, zr, nil
 }
 
-func evalIdent(expr *ast.Ident) (*big.Float, error) {
-	v, ok := tblIdent[expr.Name]
+func evalIdent(expr *ast.Ident) (*big.Float, *big.Rat, error) {
+	iv, ok := tblIdent[expr.Name]
 	if !ok {
-		return nil, errors.New("unknown ident")
+		return nil, nil, errors.New("unknown ident")
 	}
-	return v, nil
+
+	// operation1/operation2 mutate their *big.Float operands in place, so
+	// handing out the stored pointer would let any expression that reads
+	// this variable silently corrupt it. Hand out a copy instead.
+	x := new(big.Float).Set(iv.val)
+
+	var r *big.Rat
+	if iv.rat != nil {
+		r = new(big.Rat).Set(iv.rat)
+	}
+	return x, r, nil
 }
 
-func evalCallExpr(expr *ast.CallExpr) (*big.Float, error) {
+func evalCallExpr(expr *ast.CallExpr) (*big.Float, *big.Rat, error) {
 	if len(expr.Args) == 0 {
-		return nil, errors.New("no args")
+		return nil, nil, errors.New("no args")
 	}
 
 	switch e := expr.Fun.(type) {
 	case *ast.Ident:
-		var args []float64
+		var args []*big.Float
 		for _, e := range expr.Args {
-			v, err := evalExpr(e)
+			v, _, err := evalExpr(e)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			a, _ := v.Float64()
-			args = append(args, a)
+			args = append(args, v)
+		}
+
+		if fd, ok := tblFunc[e.Name]; ok {
+			return evalUserFunc(fd, args)
 		}
 
-		return evalFunc(e.Name, args)
+		z, err := evalFunc(e.Name, args)
+		return z, nil, err
 
 	case *ast.BasicLit:
 		return evalUnit(e, expr.Args[0])
 	}
 
-	return nil, errors.New("invalid call")
+	return nil, nil, errors.New("invalid call")
 }
 
-func evalFunc(fn string, args []float64) (*big.Float, error) {
-	z := new(big.Float).SetPrec(precision).SetMode(big.ToNearestEven)
+// evalUserFunc evaluates a user-defined function by binding its
+// parameters into tblIdent for the duration of the call and restoring
+// whatever was previously there (if anything) afterwards, so calls nest
+// and recurse correctly.
+func evalUserFunc(fd *funcDef, args []*big.Float) (*big.Float, *big.Rat, error) {
+	if len(args) != len(fd.params) {
+		return nil, nil, fmt.Errorf("want %d argument(s), got %d", len(fd.params), len(args))
+	}
 
+	type saved struct {
+		v  *identVal
+		ok bool
+	}
+	prev := make([]saved, len(fd.params))
+	for i, p := range fd.params {
+		v, ok := tblIdent[p]
+		prev[i] = saved{v, ok}
+		// Copy, not alias: args[i] may be the caller's own variable storage.
+		// evalCallExpr doesn't thread the argument's exact rational through
+		// (it only keeps the *big.Float), so a bound parameter is always
+		// treated as inexact.
+		tblIdent[p] = &identVal{val: new(big.Float).Set(args[i])}
+	}
+	defer func() {
+		for i, p := range fd.params {
+			if prev[i].ok {
+				tblIdent[p] = prev[i].v
+			} else {
+				delete(tblIdent, p)
+			}
+		}
+	}()
+
+	return evalExpr(fd.body)
+}
+
+func evalFunc(fn string, args []*big.Float) (*big.Float, error) {
 	switch fn {
 	case "sqrt":
-		z.SetFloat64(math.Sqrt(args[0]))
+		return bigSqrt(args[0])
 	case "sin":
-		z.SetFloat64(math.Sin(args[0]))
+		return bigSin(args[0])
 	case "cos":
-		z.SetFloat64(math.Cos(args[0]))
+		return bigCos(args[0])
 	case "tan":
-		z.SetFloat64(math.Tan(args[0]))
+		return bigTan(args[0])
 	default:
 		return nil, errors.New("unknown call " + fn)
 	}
-
-	return z, nil
 }
 
-func evalUnit(expr, unit ast.Expr) (*big.Float, error) {
+func evalUnit(expr, unit ast.Expr) (*big.Float, *big.Rat, error) {
 	u, ok := unit.(*ast.Ident)
 	if !ok {
-		return nil, errors.New("invalid unit")
+		return nil, nil, errors.New("invalid unit")
 	}
 
-	x, err := evalExpr(expr)
+	x, xr, err := evalExpr(expr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	v, ok := units[u.Name]
 	if !ok {
-		return x, errors.New("unknown unit " + u.Name)
+		return x, nil, errors.New("unknown unit " + u.Name)
 	}
 
 	z := new(big.Float).SetPrec(precision).SetMode(big.ToNearestEven)
+	// units are always exact integer scalars, so the rational form only
+	// needs xr, the operand, to be exact.
+	var zr *big.Rat
 	if v >= 0 {
 		z.SetInt64(v)
 		z = x.Mul(x, z)
+		if xr != nil {
+			zr = new(big.Rat).Mul(xr, new(big.Rat).SetInt64(v))
+		}
 	} else {
 		z.SetInt64(-v)
 		z = x.Quo(x, z)
+		if xr != nil {
+			zr = new(big.Rat).Quo(xr, new(big.Rat).SetInt64(-v))
+		}
 	}
 
-	return z, nil
+	return z, zr, nil
+}
+
+// guardBits is the number of extra bits of working precision carried
+// through the sin/cos argument reduction and Taylor series below; results
+// are rounded back down to precision before being returned. bigSqrt uses
+// its own 16 extra bits and bigPi works at piPrec.
+const guardBits = 20
+
+func epsilon(guard uint) *big.Float {
+	return new(big.Float).SetPrec(guard).SetMantExp(big.NewFloat(1), -precision)
+}
+
+func bigSqrt(x *big.Float) (*big.Float, error) {
+	switch x.Sign() {
+	case 0:
+		return new(big.Float).SetPrec(precision).SetMode(big.ToNearestEven), nil
+	case -1:
+		return nil, errors.New("sqrt of negative number")
+	}
+
+	guard := uint(precision + 16)
+	xg := new(big.Float).SetPrec(guard).Set(x)
+
+	// Seed the Newton iteration from x's mantissa/exponent rather than
+	// x.Float64() directly: x = mant * 2^exp with mant in [0.5, 1), so for
+	// |x| well outside float64's ~1e±308 range, x.Float64() over/underflows
+	// to Inf/0 and the iteration below diverges. mant itself is always in
+	// range, so sqrt(mant) is safe; scale the result by 2^(exp/2) exactly
+	// via SetMantExp, splitting off an extra factor of 2 when exp is odd.
+	mant := new(big.Float).SetPrec(guard)
+	exp := x.MantExp(mant)
+	halfExp := exp >> 1
+	two := new(big.Float).SetPrec(guard).SetInt64(2)
+	if exp-2*halfExp != 0 {
+		mant.Mul(mant, two)
+	}
+	mantF64, _ := mant.Float64()
+	y := new(big.Float).SetPrec(guard).SetFloat64(math.Sqrt(mantF64))
+	y.SetMantExp(y, halfExp)
+
+	// eps is a relative threshold (applied to diff/y below), not an
+	// absolute one: an absolute threshold is reached after far fewer
+	// Newton steps once y's magnitude is well below 1, so small-magnitude
+	// results would get fewer correct digits than precision promises.
+	eps := epsilon(guard)
+	for {
+		next := new(big.Float).SetPrec(guard).Quo(xg, y)
+		next.Add(next, y)
+		next.Quo(next, two)
+
+		diff := new(big.Float).SetPrec(guard).Sub(next, y)
+		diff.Abs(diff)
+		y = next
+
+		rel := new(big.Float).SetPrec(guard).Quo(diff, y)
+		if rel.Cmp(eps) < 0 {
+			break
+		}
+	}
+
+	return new(big.Float).SetPrec(precision).SetMode(big.ToNearestEven).Set(y), nil
+}
+
+// bigArctanInv computes arctan(1/n) via the series
+// sum_k (-1)^k / ((2k+1) n^(2k+1)), at the given working precision.
+func bigArctanInv(n int64, guard uint) *big.Float {
+	x := new(big.Float).SetPrec(guard).Quo(big.NewFloat(1), new(big.Float).SetPrec(guard).SetInt64(n))
+	xSq := new(big.Float).SetPrec(guard).Mul(x, x)
+
+	sum := new(big.Float).SetPrec(guard)
+	power := new(big.Float).SetPrec(guard).Set(x)
+	eps := epsilon(guard)
+	neg := false
+
+	for k := 0; ; k++ {
+		term := new(big.Float).SetPrec(guard).Quo(power, new(big.Float).SetPrec(guard).SetInt64(int64(2*k+1)))
+		if neg {
+			sum.Sub(sum, term)
+		} else {
+			sum.Add(sum, term)
+		}
+
+		absTerm := new(big.Float).SetPrec(guard).Abs(term)
+		if absTerm.Cmp(eps) < 0 {
+			break
+		}
+
+		power.Mul(power, xSq)
+		neg = !neg
+	}
+
+	return sum
+}
+
+// piPrec is the precision bigPi computes and caches pi at, well above
+// precision; bigSinCos rounds the result to its own working precision
+// (precision + guardBits) before using it for argument reduction.
+const piPrec = precision + 64
+
+var piCache *big.Float
+
+// bigPi returns pi computed once via Machin's formula
+// pi = 16*arctan(1/5) - 4*arctan(1/239), cached at piPrec bits.
+func bigPi() *big.Float {
+	if piCache == nil {
+		a := bigArctanInv(5, piPrec)
+		a.Mul(a, new(big.Float).SetPrec(piPrec).SetInt64(16))
+
+		b := bigArctanInv(239, piPrec)
+		b.Mul(b, new(big.Float).SetPrec(piPrec).SetInt64(4))
+
+		piCache = new(big.Float).SetPrec(piPrec).Sub(a, b)
+	}
+
+	return new(big.Float).SetPrec(piPrec).Set(piCache)
+}
+
+// taylorSinCos evaluates sin(r) and cos(r) by Taylor series for
+// |r| <= pi/4, at the given working precision.
+func taylorSinCos(r *big.Float, guard uint) (sin, cos *big.Float) {
+	rSq := new(big.Float).SetPrec(guard).Mul(r, r)
+	rSq.Neg(rSq)
+	eps := epsilon(guard)
+
+	sin = new(big.Float).SetPrec(guard).Set(r)
+	sinTerm := new(big.Float).SetPrec(guard).Set(r)
+	for k := 0; ; k++ {
+		sinTerm.Mul(sinTerm, rSq)
+		sinTerm.Quo(sinTerm, new(big.Float).SetPrec(guard).SetInt64(int64((2*k+2)*(2*k+3))))
+		sin.Add(sin, sinTerm)
+
+		abs := new(big.Float).SetPrec(guard).Abs(sinTerm)
+		if abs.Cmp(eps) < 0 {
+			break
+		}
+	}
+
+	cos = new(big.Float).SetPrec(guard).SetInt64(1)
+	cosTerm := new(big.Float).SetPrec(guard).SetInt64(1)
+	for k := 0; ; k++ {
+		cosTerm.Mul(cosTerm, rSq)
+		cosTerm.Quo(cosTerm, new(big.Float).SetPrec(guard).SetInt64(int64((2*k+1)*(2*k+2))))
+		cos.Add(cos, cosTerm)
+
+		abs := new(big.Float).SetPrec(guard).Abs(cosTerm)
+		if abs.Cmp(eps) < 0 {
+			break
+		}
+	}
+
+	return sin, cos
+}
+
+// bigSinCos reduces x modulo 2*pi and then to within pi/4 of zero using
+// the quadrant of pi/2 it falls in, before handing off to taylorSinCos.
+func bigSinCos(x *big.Float) (sin, cos *big.Float) {
+	guard := uint(precision + guardBits)
+
+	pi := new(big.Float).SetPrec(guard).Set(bigPi())
+	halfPi := new(big.Float).SetPrec(guard).Quo(pi, new(big.Float).SetPrec(guard).SetInt64(2))
+	twoPi := new(big.Float).SetPrec(guard).Mul(pi, new(big.Float).SetPrec(guard).SetInt64(2))
+
+	xg := new(big.Float).SetPrec(guard).Set(x)
+	k := floorDiv(xg, twoPi, guard)
+	xr := new(big.Float).SetPrec(guard).Sub(xg, new(big.Float).SetPrec(guard).Mul(k, twoPi))
+
+	q := floorDiv(xr, halfPi, guard)
+	r := new(big.Float).SetPrec(guard).Sub(xr, new(big.Float).SetPrec(guard).Mul(q, halfPi))
+
+	qi, _ := q.Int64()
+	quadrant := ((qi % 4) + 4) % 4
+
+	// r is now in [0, pi/2); fold it into [0, pi/4] via
+	// sin(r) = cos(pi/2-r) and cos(r) = sin(pi/2-r).
+	quarterPi := new(big.Float).SetPrec(guard).Quo(halfPi, new(big.Float).SetPrec(guard).SetInt64(2))
+	swap := r.Cmp(quarterPi) > 0
+	if swap {
+		r.Sub(halfPi, r)
+	}
+
+	sinR, cosR := taylorSinCos(r, guard)
+	if swap {
+		sinR, cosR = cosR, sinR
+	}
+
+	switch quadrant {
+	case 0:
+		sin, cos = sinR, cosR
+	case 1:
+		sin, cos = cosR, new(big.Float).SetPrec(guard).Neg(sinR)
+	case 2:
+		sin, cos = new(big.Float).SetPrec(guard).Neg(sinR), new(big.Float).SetPrec(guard).Neg(cosR)
+	default:
+		sin, cos = new(big.Float).SetPrec(guard).Neg(cosR), sinR
+	}
+
+	return new(big.Float).SetPrec(precision).SetMode(big.ToNearestEven).Set(sin),
+		new(big.Float).SetPrec(precision).SetMode(big.ToNearestEven).Set(cos)
+}
+
+// floorDiv returns floor(x/y) as a *big.Float integer value.
+func floorDiv(x, y *big.Float, guard uint) *big.Float {
+	q := new(big.Float).SetPrec(guard).Quo(x, y)
+	i, acc := q.Int(nil)
+	f := new(big.Float).SetPrec(guard).SetInt(i)
+	if acc != big.Exact && q.Sign() < 0 {
+		f.Sub(f, new(big.Float).SetPrec(guard).SetInt64(1))
+	}
+	return f
+}
+
+func bigSin(x *big.Float) (*big.Float, error) {
+	sin, _ := bigSinCos(x)
+	return sin, nil
+}
+
+func bigCos(x *big.Float) (*big.Float, error) {
+	_, cos := bigSinCos(x)
+	return cos, nil
+}
+
+func bigTan(x *big.Float) (*big.Float, error) {
+	sin, cos := bigSinCos(x)
+	if cos.Sign() == 0 {
+		return nil, errors.New("tan undefined (cos is zero)")
+	}
+	return new(big.Float).SetPrec(precision).SetMode(big.ToNearestEven).Quo(sin, cos), nil
+}
+
+// printVars lists the variables currently stored in tblIdent.
+func printVars() {
+	if len(tblIdent) == 0 {
+		fmt.Println("(no variables defined)")
+		return
+	}
+
+	names := make([]string, 0, len(tblIdent))
+	for name := range tblIdent {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s = %s\n", name, fmt.Sprint(tblIdent[name].val))
+	}
+}
+
+// printFuncs lists the functions currently stored in tblFunc.
+func printFuncs() {
+	if len(tblFunc) == 0 {
+		fmt.Println("(no functions defined)")
+		return
+	}
+
+	names := make([]string, 0, len(tblFunc))
+	for name := range tblFunc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fd := tblFunc[name]
+		fmt.Printf("%s(%s) = %s\n", name, strings.Join(fd.params, ", "), fd.src)
+	}
 }
 
 func printAst(tree ast.Expr) {
@@ -254,19 +862,132 @@ func printAst(tree ast.Expr) {
 	fmt.Println()
 }
 
-func answer(line string) (s []string, err error) {
-	line = preconv(line)
+// traceLine parses and evaluates line like evalLine, but also captures the
+// value of every sub-expression for the Ctrl-T trace pane.
+func traceLine(line string) (ast.Expr, map[ast.Node]*big.Float, error) {
+	tree, err := parser.ParseExpr(preconv(line))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	traceMap = map[ast.Node]*big.Float{}
+	_, _, err = evalExpr(tree)
+	values := traceMap
+	traceMap = nil
+
+	return tree, values, err
+}
+
+// astNodeLabel gives a one-line, human-readable label for an AST node,
+// mirroring how printAst prints it but naming the operator instead of
+// dumping the whole node with %v.
+func astNodeLabel(n ast.Node) string {
+	switch e := n.(type) {
+	case *ast.BinaryExpr:
+		return "BinaryExpr " + e.Op.String()
+	case *ast.UnaryExpr:
+		return "UnaryExpr " + e.Op.String()
+	case *ast.BasicLit:
+		return "BasicLit " + e.Value
+	case *ast.Ident:
+		return "Ident " + e.Name
+	default:
+		return fmt.Sprintf("%T", n)
+	}
+}
+
+// printAstAnnotated renders tree the way printAst does, but appends each
+// sub-expression's evaluated value from values in brackets, e.g.
+// "BinaryExpr + [5]".
+func printAstAnnotated(tree ast.Expr, values map[ast.Node]*big.Float) []string {
+	var lines []string
+	depth := 0
+	ast.Inspect(tree, func(n ast.Node) bool {
+		if n == nil {
+			depth--
+			return true
+		}
+
+		line := strings.Repeat("  ", depth) + astNodeLabel(n)
+		if v, ok := values[n]; ok {
+			line += fmt.Sprintf(" [%s]", fmt.Sprint(v))
+		}
+		lines = append(lines, line)
+		depth++
 
-	tree, err := parser.ParseExpr(line)
+		return true
+	})
+	return lines
+}
+
+// evalLine runs the full preconv + parse + evaluate pipeline for a single
+// expression (no assignment or function-definition syntax).
+func evalLine(line string) (*big.Float, *big.Rat, error) {
+	tree, err := parser.ParseExpr(preconv(line))
 	if err != nil {
-		return s, err
+		return nil, nil, err
 	}
 
 	//printAst(tree)
-	ans, err := evalExpr(tree)
+	return evalExpr(tree)
+}
+
+// answer evaluates line, a full REPL command (function definition,
+// assignment, or plain expression), and returns its display lines. It
+// only commits an assignment or function definition to tblIdent/tblFunc
+// when commit is true; callers previewing a line that hasn't been
+// entered yet (the live per-keystroke redraw) must pass false so that
+// browsing history or backspacing out of a half-typed assignment can't
+// clobber a variable or function as a side effect of display.
+func answer(line string, commit bool) (s []string, err error) {
+	if name, params, rhs, ok := parseFuncDef(line); ok {
+		body, err := parser.ParseExpr(preconv(rhs))
+		if err != nil {
+			return s, err
+		}
+		if commit {
+			tblFunc[name] = &funcDef{params: params, body: body, src: rhs}
+		}
+		return []string{name + "(" + strings.Join(params, ", ") + ") defined"}, nil
+	}
+
+	if name, rhs, ok := parseAssign(line); ok {
+		ans, ratAns, err := evalLine(rhs)
+		if err != nil {
+			return s, err
+		}
+		if commit {
+			tblIdent[name] = &identVal{val: ans, rat: ratAns}
+		}
+		return formatAnswer(ans, ratAns)
+	}
+
+	ans, ratAns, err := evalLine(line)
 	if err != nil {
 		return s, err
 	}
+	return formatAnswer(ans, ratAns)
+}
+
+func formatAnswer(ans *big.Float, ratAns *big.Rat) (s []string, err error) {
+	switch fmtState.mode {
+	case "sci":
+		s = append(s, ans.Text('e', fmtState.digits))
+		return s, nil
+	case "fix":
+		s = append(s, ans.Text('f', fmtState.digits))
+		return s, nil
+	case "eng":
+		s = append(s, formatEng(ans))
+		return s, nil
+	case "base":
+		if !ans.IsInt() {
+			return nil, errors.New(":fmt base only supports integer results")
+		}
+		v, _ := ans.Int(nil)
+		s = append(s, formatBase(v, fmtState.base))
+		return s, nil
+	}
 
 	v, _ := ans.Int(nil)
 	if ans.IsInt() && v.BitLen() <= showmaxbits {
@@ -293,6 +1014,14 @@ func answer(line string) (s []string, err error) {
 	} else {
 		s = append(s, fmt.Sprint(ans))
 		//s = append(s, ans.Text('f', 16))
+
+		if outputMode != "float" {
+			if ratAns != nil {
+				s = append(s, ratAns.RatString())
+			} else if outputMode == "rat" {
+				return s, errors.New("result has no exact rational representation")
+			}
+		}
 	}
 
 	return s, nil
@@ -325,7 +1054,34 @@ func main() {
 		if err != nil {
 			break
 		}
-		ans, err := answer(line)
+
+		if strings.HasPrefix(line, ":fmt") {
+			if err := parseFmtDirective(line); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("output format set to", fmtState.mode)
+			}
+			continue
+		}
+
+		switch line {
+		case ":rat":
+			outputMode = "rat"
+			fmt.Println("output mode: rat")
+			continue
+		case ":float":
+			outputMode = "float"
+			fmt.Println("output mode: float")
+			continue
+		case ":vars":
+			printVars()
+			continue
+		case ":funcs":
+			printFuncs()
+			continue
+		}
+
+		ans, err := answer(line, true)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -390,21 +1146,48 @@ func printAns(ans []string) int {
 	return num
 }
 
+// ctrlT is the key code readline reports for Ctrl-T.
+const ctrlT = 0x14
+
+// traceMode toggles the live AST/evaluation trace pane, via Ctrl-T.
+var traceMode bool
+
 func keyListener(line []rune, pos int, key rune) ([]rune, int, bool) {
 	switch key {
 	case '\n', '\r', 0x04, 0:
 		// do nothing
+	case ctrlT:
+		traceMode = !traceMode
+		redrawPane(line, pos)
 	default:
-		ans, _ := answer(string(line))
-
-		fmt.Print(escEnter)
-		n := printAns(ans)
-		out := fmt.Sprintf(escUp, n+1)
-		out += fmt.Sprintf(escRight, len(prompt)+pos)
-		fmt.Print(out)
+		redrawPane(line, pos)
 	}
 
 	return nil, 0, false
 }
 
+// redrawPane re-evaluates line and redraws the answer (and, in trace mode,
+// the annotated AST above it) in place, using the same cursor-save/restore
+// escape sequences as the plain answer pane.
+func redrawPane(line []rune, pos int) {
+	fmt.Print(escEnter)
+
+	rows := 0
+	if traceMode {
+		if tree, values, err := traceLine(string(line)); err == nil {
+			for _, l := range printAstAnnotated(tree, values) {
+				fmt.Println(l + escKill)
+				rows++
+			}
+		}
+	}
+
+	ans, _ := answer(string(line), false)
+	rows += printAns(ans)
+
+	out := fmt.Sprintf(escUp, rows+1)
+	out += fmt.Sprintf(escRight, len(prompt)+pos)
+	fmt.Print(out)
+}
+
 /// line_calc.go ends here
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+// resetState clears the package-level variable/function tables so tests
+// don't leak identifiers into one another.
+func resetState() {
+	tblIdent = map[string]*identVal{}
+	tblFunc = map[string]*funcDef{}
+}
+
+func TestRationalRoundTrip(t *testing.T) {
+	resetState()
+	s, err := answer("1/3*3", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s[0] != "1" {
+		t.Fatalf("1/3*3 = %v, want 1", s)
+	}
+}
+
+func TestReadingVariableDoesNotMutateIt(t *testing.T) {
+	resetState()
+	if _, err := answer("y = 5", true); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := answer("y + 1", true); err != nil || s[0] != "6" {
+		t.Fatalf("y + 1 = %v, %v, want 6", s, err)
+	}
+	if s, err := answer("y", true); err != nil || s[0] != "5" {
+		t.Fatalf("y = %v, %v, want still 5", s, err)
+	}
+}
+
+func TestFuncArgDoesNotAliasCaller(t *testing.T) {
+	resetState()
+	if _, err := answer("y = 5", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := answer("f(x) = -x", true); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := answer("f(y)", true); err != nil || s[0] != "-5" {
+		t.Fatalf("f(y) = %v, %v, want -5", s, err)
+	}
+	if s, err := answer("y", true); err != nil || s[0] != "5" {
+		t.Fatalf("y = %v, %v, want still 5 after f(y)", s, err)
+	}
+}
+
+// TestSqrtSmallMagnitudeHasFullPrecision guards against an absolute Newton
+// stopping threshold, which is satisfied after far fewer steps once the
+// result's magnitude is well below 1, shortchanging small results of the
+// precision large ones get.
+func TestSqrtSmallMagnitudeHasFullPrecision(t *testing.T) {
+	x, _, err := big.ParseFloat("1e-400", 10, precision, big.ToNearestEven)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := bigSqrt(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _, err := big.ParseFloat("1e-200", 10, precision, big.ToNearestEven)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one part in 2^120: comfortably tighter than the ~34 decimal digits
+	// (~113 bits) the old absolute threshold gave, short of the full
+	// 128-bit precision to leave headroom for the last-bit rounding.
+	relTol := new(big.Float).SetPrec(precision).SetMantExp(big.NewFloat(1), -120)
+
+	diff := new(big.Float).SetPrec(precision).Sub(got, want)
+	diff.Abs(diff)
+	rel := new(big.Float).SetPrec(precision).Quo(diff, want)
+	if rel.Cmp(relTol) >= 0 {
+		t.Fatalf("sqrt(1e-400) relative error %v exceeds %v (got %s)", rel, relTol, got.Text('e', 20))
+	}
+}
+
+func TestSqrtExtremeMagnitudeDoesNotPanic(t *testing.T) {
+	big1e400, _, err := big.ParseFloat("1e400", 10, precision, big.ToNearestEven)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := bigSqrt(big1e400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Text('e', 4); got != "1.0000e+200" {
+		t.Fatalf("sqrt(1e400) = %s, want 1.0000e+200", got)
+	}
+
+	big1eneg400, _, err := big.ParseFloat("1e-400", 10, precision, big.ToNearestEven)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = bigSqrt(big1eneg400); err != nil {
+		t.Fatal(err)
+	} else if got := r.Text('e', 4); got != "1.0000e-200" {
+		t.Fatalf("sqrt(1e-400) = %s, want 1.0000e-200", got)
+	}
+}
+
+func TestVariableFromIrrationalResultIsNotExact(t *testing.T) {
+	resetState()
+	if _, err := answer("x = sqrt(2)", true); err != nil {
+		t.Fatal(err)
+	}
+	s, err := answer("x", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 1 {
+		t.Fatalf("x = %v, want a single (non-exact) float line", s)
+	}
+}
+
+func TestPreviewDoesNotCommit(t *testing.T) {
+	resetState()
+	if _, err := answer("x = 5", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tblIdent["x"]; ok {
+		t.Fatal("answer(..., false) committed an assignment to tblIdent")
+	}
+
+	if _, err := answer("g(x) = x", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tblFunc["g"]; ok {
+		t.Fatal("answer(..., false) committed a function definition to tblFunc")
+	}
+}
+
+func TestPreconvDoesNotMangleIdentContainingPi(t *testing.T) {
+	resetState()
+	if _, err := answer("pivot = 5", true); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := answer("pivot + 1", true); err != nil || s[0] != "6" {
+		t.Fatalf("pivot + 1 = %v, %v, want 6", s, err)
+	}
+}